@@ -48,6 +48,11 @@
 	req("/debug/metrics"):           handleC2NDebugMetrics,
 	req("/debug/component-logging"): handleC2NDebugComponentLogging,
 	req("/debug/logheap"):           handleC2NDebugLogHeap,
+	req("/debug/pprof/profile"):     handleC2NDebugCPUProfile,
+	req("/debug/pprof/lookup"):      handleC2NDebugPprof,
+	req("/debug/pprof/profiles"):    handleC2NDebugPprofProfiles,
+	req("/debug/pprof/trace"):       handleC2NDebugTrace,
+	req("/debug/pprof/rate"):        handleC2NDebugProfileRate,
 	req("POST /logtail/flush"):      handleC2NLogtailFlush,
 	req("POST /sockstats"):          handleC2NSockStats,
 
@@ -178,6 +183,64 @@ func handleC2NDebugLogHeap(b *LocalBackend, w http.ResponseWriter, r *http.Reque
 	c2nLogHeap(w, r)
 }
 
+var c2nCPUProfile func(http.ResponseWriter, *http.Request) // non-nil on most platforms (c2n_pprof.go)
+
+func handleC2NDebugCPUProfile(b *LocalBackend, w http.ResponseWriter, r *http.Request) {
+	if c2nCPUProfile == nil {
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+		return
+	}
+	c2nCPUProfile(w, r)
+}
+
+var c2nPprof func(w http.ResponseWriter, r *http.Request, profile string) // non-nil on most platforms (c2n_pprof.go)
+
+// handleC2NDebugPprof serves the runtime/pprof profile named by the
+// "profile" query parameter: one of the standard profiles (allocs, block,
+// goroutine, heap, mutex, threadcreate) or any custom profile. See
+// handleC2NDebugPprofProfiles for the list.
+func handleC2NDebugPprof(b *LocalBackend, w http.ResponseWriter, r *http.Request) {
+	if c2nPprof == nil {
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+		return
+	}
+	c2nPprof(w, r, r.FormValue("profile"))
+}
+
+var c2nPprofProfiles func() []tailcfg.C2NPprofProfile // non-nil on most platforms (c2n_pprof.go)
+
+// handleC2NDebugPprofProfiles lists the profiles that handleC2NDebugPprof can
+// serve.
+func handleC2NDebugPprofProfiles(b *LocalBackend, w http.ResponseWriter, r *http.Request) {
+	if c2nPprofProfiles == nil {
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+		return
+	}
+	writeJSON(w, c2nPprofProfiles())
+}
+
+var c2nTrace func(http.ResponseWriter, *http.Request) // non-nil on most platforms (c2n_pprof.go)
+
+func handleC2NDebugTrace(b *LocalBackend, w http.ResponseWriter, r *http.Request) {
+	if c2nTrace == nil {
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+		return
+	}
+	c2nTrace(w, r)
+}
+
+var c2nProfileRate func(http.ResponseWriter, *http.Request) // non-nil on most platforms (c2n_pprof.go)
+
+// handleC2NDebugProfileRate reports (GET) or changes (POST) the runtime's
+// profile sampling rates.
+func handleC2NDebugProfileRate(b *LocalBackend, w http.ResponseWriter, r *http.Request) {
+	if c2nProfileRate == nil {
+		http.Error(w, "not implemented", http.StatusNotImplemented)
+		return
+	}
+	c2nProfileRate(w, r)
+}
+
 func handleC2NSSHUsernames(b *LocalBackend, w http.ResponseWriter, r *http.Request) {
 	var req tailcfg.C2NSSHUsernamesRequest
 	if r.Method == "POST" {
@@ -6,18 +6,365 @@
 package ipnlocal
 
 import (
+	"compress/gzip"
+	"errors"
+	"fmt"
 	"net/http"
 	"runtime"
 	"runtime/pprof"
+	"runtime/trace"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/clientmetric"
+)
+
+// c2n responses aren't streamed: the control client buffers the whole
+// response in memory before sending it back (see answerC2NPing). The handler's
+// context also ends after a minute unless control sends a longer
+// C2n-Handler-Timeout header; profiles and traces cut short that way still
+// return 200 with whatever was collected.
+const (
+	// c2nDefaultProfileDuration is how long a CPU profile runs when the
+	// request doesn't specify a "seconds" parameter.
+	c2nDefaultProfileDuration = 30 * time.Second
+
+	// c2nMaxProfileDuration is the longest CPU profile a c2n request may
+	// ask for. Longer requests are clamped to it.
+	c2nMaxProfileDuration = 5 * time.Minute
+
+	// c2nDefaultTraceDuration and c2nMaxTraceDuration are like
+	// c2nDefaultProfileDuration and c2nMaxProfileDuration, but for
+	// execution traces. Traces grow much faster than CPU profiles and are
+	// held in memory until the request completes, so they're capped much
+	// lower to protect memory-constrained nodes (e.g. the iOS network
+	// extension).
+	c2nDefaultTraceDuration = 5 * time.Second
+	c2nMaxTraceDuration     = 30 * time.Second
+)
+
+// c2nProfileDescriptions describes the standard runtime/pprof profiles, for
+// the /debug/pprof/profiles index. The text matches the index page served by
+// net/http/pprof.
+var c2nProfileDescriptions = map[string]string{
+	"allocs":       "A sampling of all past memory allocations",
+	"block":        "Stack traces that led to blocking on synchronization primitives",
+	"goroutine":    "Stack traces of all current goroutines. Use debug=2 as a query parameter to export in the same format as an unrecovered panic.",
+	"heap":         "A sampling of memory allocations of live objects. You can specify the gc GET parameter to run GC before taking the heap sample.",
+	"mutex":        "Stack traces of holders of contended mutexes",
+	"threadcreate": "Stack traces that led to the creation of new OS threads",
+}
+
+// c2nCPUProfileActive and c2nTraceActive are whether a c2n CPU profile or
+// execution trace, respectively, is in progress. The runtime only supports one
+// of each at a time, so overlapping requests are rejected with a 409.
+var (
+	c2nCPUProfileActive atomic.Bool
+	c2nTraceActive      atomic.Bool
 )
 
 func init() {
 	c2nLogHeap = func(w http.ResponseWriter, r *http.Request) {
+		metricC2NPprofLookup("heap").Add(1)
 		// Support same optional gc parameter as net/http/pprof:
 		if gc, _ := strconv.Atoi(r.FormValue("gc")); gc > 0 {
 			runtime.GC()
 		}
 		pprof.WriteHeapProfile(w)
 	}
+	c2nCPUProfile = func(w http.ResponseWriter, r *http.Request) {
+		metricC2NPprofCPU.Add(1)
+		d, err := c2nProfileDuration(r, c2nDefaultProfileDuration, c2nMaxProfileDuration)
+		if err != nil {
+			c2nPprofError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !c2nCPUProfileActive.CompareAndSwap(false, true) {
+			c2nPprofError(w, "CPU profile already in progress", http.StatusConflict)
+			return
+		}
+		defer c2nCPUProfileActive.Store(false)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		if err := pprof.StartCPUProfile(w); err != nil {
+			c2nPprofError(w, "could not enable CPU profiling: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		c2nSleep(r, d)
+		pprof.StopCPUProfile()
+	}
+	c2nPprof = func(w http.ResponseWriter, r *http.Request, profile string) {
+		if profile == "" {
+			c2nPprofError(w, "no 'profile'", http.StatusBadRequest)
+			return
+		}
+		metricC2NPprofLookup(profile).Add(1)
+		p := pprof.Lookup(profile)
+		if p == nil {
+			c2nPprofError(w, "unknown profile", http.StatusBadRequest)
+			return
+		}
+		// The heap and allocs profiles hold the same data (they only differ
+		// in their default sample type), so both honor gc.
+		if gc, _ := strconv.Atoi(r.FormValue("gc")); gc > 0 && (profile == "heap" || profile == "allocs") {
+			runtime.GC()
+		}
+		debug := c2nPprofDebug(r)
+		if debug == 0 {
+			// The binary format is already gzip-compressed.
+			w.Header().Set("Content-Type", "application/octet-stream")
+			p.WriteTo(w, debug)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		zw := newC2NProfileWriter(w, r)
+		defer zw.Close()
+		p.WriteTo(zw, debug)
+	}
+	c2nPprofProfiles = func() []tailcfg.C2NPprofProfile {
+		metricC2NPprofProfiles.Add(1)
+		profiles := pprof.Profiles() // sorted by name
+		ret := make([]tailcfg.C2NPprofProfile, 0, len(profiles))
+		for _, p := range profiles {
+			ret = append(ret, tailcfg.C2NPprofProfile{
+				Name:        p.Name(),
+				Count:       p.Count(),
+				Description: c2nProfileDescriptions[p.Name()],
+			})
+		}
+		return ret
+	}
+	c2nTrace = func(w http.ResponseWriter, r *http.Request) {
+		metricC2NPprofTrace.Add(1)
+		d, err := c2nProfileDuration(r, c2nDefaultTraceDuration, c2nMaxTraceDuration)
+		if err != nil {
+			c2nPprofError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !c2nTraceActive.CompareAndSwap(false, true) {
+			c2nPprofError(w, "trace already in progress", http.StatusConflict)
+			return
+		}
+		defer c2nTraceActive.Store(false)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		zw := newC2NProfileWriter(w, r)
+		defer zw.Close()
+		if err := trace.Start(zw); err != nil {
+			c2nPprofError(w, "could not enable tracing: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		c2nSleep(r, d)
+		trace.Stop()
+	}
+	c2nProfileRate = func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "POST" {
+			c2nPprofError(w, "bad method", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Method == "POST" {
+			metricC2NPprofSetRate.Add(1)
+			if err := c2nSetProfileRate(r.FormValue("profile"), r.FormValue("rate")); err != nil {
+				c2nPprofError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		} else {
+			metricC2NPprofGetRate.Add(1)
+		}
+		writeJSON(w, c2nProfileRates())
+	}
+}
+
+var (
+	// c2nProfileRateMu guards reads and writes of runtime.MemProfileRate
+	// (a plain int) by concurrent c2n requests, and c2nBlockProfileRate.
+	c2nProfileRateMu sync.Mutex
+
+	// c2nBlockProfileRate is the block profile rate last set via c2n. The
+	// runtime doesn't provide a way to read it back.
+	c2nBlockProfileRate int // guarded by c2nProfileRateMu
+)
+
+// c2nProfileRates returns the current profile sampling rates.
+func c2nProfileRates() tailcfg.C2NPprofRates {
+	c2nProfileRateMu.Lock()
+	defer c2nProfileRateMu.Unlock()
+	return tailcfg.C2NPprofRates{
+		MemProfileRate:       runtime.MemProfileRate,
+		MutexProfileFraction: runtime.SetMutexProfileFraction(-1),
+		BlockProfileRate:     c2nBlockProfileRate,
+	}
+}
+
+// c2nSetProfileRate sets the sampling rate for the named profile ("heap" or
+// its alias "allocs", "mutex", or "block") to the integer in rateStr.
+//
+// The runtime docs say MemProfileRate should be set once, as early as
+// possible. Changing it at runtime works, but a heap profile taken afterwards
+// mixes samples recorded at the old and new rates. To get a clean capture,
+// set the rate, let the workload of interest run, take the profile, then reset
+// the rate to its previous value.
+func c2nSetProfileRate(profile, rateStr string) error {
+	rate, err := strconv.Atoi(rateStr)
+	if err != nil || rate < 0 {
+		return fmt.Errorf("invalid rate %q", rateStr)
+	}
+	c2nProfileRateMu.Lock()
+	defer c2nProfileRateMu.Unlock()
+	switch profile {
+	case "heap", "allocs":
+		// On average one allocation per rate bytes is sampled. Zero
+		// would stop recording the heap profile entirely.
+		if rate == 0 {
+			return errors.New("refusing to disable memory profiling")
+		}
+		runtime.MemProfileRate = rate
+	case "mutex":
+		// On average 1/rate of mutex contention events are reported. Zero
+		// turns the profile off.
+		runtime.SetMutexProfileFraction(rate)
+	case "block":
+		// On average one blocking event per rate nanoseconds spent blocked
+		// is reported. Zero turns the profile off.
+		runtime.SetBlockProfileRate(rate)
+		c2nBlockProfileRate = rate
+	default:
+		return fmt.Errorf("unknown profile %q", profile)
+	}
+	return nil
+}
+
+// c2nPprofDebug returns r's "debug" parameter for Profile.WriteTo, clamped to
+// 0 through 2. Like net/http/pprof, debug=1 selects the legacy text format,
+// and debug=2 additionally prints goroutine stacks in the same form as an
+// unrecovered panic. Other profiles treat 2 the same as 1.
+func c2nPprofDebug(r *http.Request) int {
+	debug, _ := strconv.Atoi(r.FormValue("debug"))
+	return min(max(debug, 0), 2)
+}
+
+// c2nPprofError is like http.Error, but also counts the failure in
+// metricC2NPprofErrors.
+func c2nPprofError(w http.ResponseWriter, msg string, code int) {
+	metricC2NPprofErrors.Add(1)
+	http.Error(w, msg, code)
+}
+
+// c2nProfileDuration returns the CPU profile or trace duration requested by
+// r's optional "seconds" parameter, defaulting to def and clamped to maxDur.
+func c2nProfileDuration(r *http.Request, def, maxDur time.Duration) (time.Duration, error) {
+	v := r.FormValue("seconds")
+	if v == "" {
+		return def, nil
+	}
+	sec, err := strconv.Atoi(v)
+	if err != nil || sec <= 0 {
+		return 0, fmt.Errorf("invalid seconds %q", v)
+	}
+	return min(time.Duration(sec)*time.Second, maxDur), nil
+}
+
+// c2nSleep sleeps for d or until r's context is done, whichever comes first.
+func c2nSleep(r *http.Request, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-r.Context().Done():
+	}
+}
+
+// c2nProfileWriter is an io.Writer for the body of a c2n profile response.
+// If the client accepts gzip, the body is compressed.
+//
+// It's only used for output that isn't already compressed: text profiles and
+// execution traces. The binary pprof format is gzipped protobuf, so
+// compressing it again would cost CPU for no gain.
+//
+// The Content-Encoding header is only set on the first Write, so handlers can
+// still reply with http.Error on the underlying ResponseWriter as long as
+// nothing has been written yet.
+type c2nProfileWriter struct {
+	w    http.ResponseWriter
+	gzip bool         // whether to compress the response
+	zw   *gzip.Writer // lazily created on first Write if gzip
+}
+
+func newC2NProfileWriter(w http.ResponseWriter, r *http.Request) *c2nProfileWriter {
+	w.Header().Add("Vary", "Accept-Encoding")
+	return &c2nProfileWriter{w: w, gzip: acceptsGzip(r)}
+}
+
+func (pw *c2nProfileWriter) Write(p []byte) (int, error) {
+	if !pw.gzip {
+		return pw.w.Write(p)
+	}
+	if pw.zw == nil {
+		pw.w.Header().Set("Content-Encoding", "gzip")
+		pw.zw = gzip.NewWriter(pw.w)
+	}
+	return pw.zw.Write(p)
+}
+
+// Close flushes any compressed data. It does not close the underlying
+// ResponseWriter.
+func (pw *c2nProfileWriter) Close() error {
+	if pw.zw == nil {
+		return nil
+	}
+	return pw.zw.Close()
+}
+
+// acceptsGzip reports whether r's Accept-Encoding header includes gzip with a
+// non-zero quality value. "gzip;q=0" means the client refuses gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(enc, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			continue
+		}
+		for _, param := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if !strings.EqualFold(k, "q") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil || q <= 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+var (
+	metricC2NPprofCPU      = clientmetric.NewCounter("c2n_pprof_cpu")
+	metricC2NPprofTrace    = clientmetric.NewCounter("c2n_pprof_trace")
+	metricC2NPprofSetRate  = clientmetric.NewCounter("c2n_pprof_set_rate")
+	metricC2NPprofGetRate  = clientmetric.NewCounter("c2n_pprof_get_rate")
+	metricC2NPprofProfiles = clientmetric.NewCounter("c2n_pprof_profiles")
+	metricC2NPprofErrors   = clientmetric.NewCounter("c2n_pprof_errors")
+
+	// metricC2NPprofLookups counts fetches of the standard named profiles.
+	// Fetches of any other profile name are counted in
+	// metricC2NPprofLookupOther.
+	metricC2NPprofLookups = map[string]*clientmetric.Metric{
+		"allocs":       clientmetric.NewCounter("c2n_pprof_allocs"),
+		"block":        clientmetric.NewCounter("c2n_pprof_block"),
+		"goroutine":    clientmetric.NewCounter("c2n_pprof_goroutine"),
+		"heap":         clientmetric.NewCounter("c2n_pprof_heap"),
+		"mutex":        clientmetric.NewCounter("c2n_pprof_mutex"),
+		"threadcreate": clientmetric.NewCounter("c2n_pprof_threadcreate"),
+	}
+	metricC2NPprofLookupOther = clientmetric.NewCounter("c2n_pprof_other")
+)
+
+// metricC2NPprofLookup returns the counter for fetches of the named profile.
+func metricC2NPprofLookup(profile string) *clientmetric.Metric {
+	if m, ok := metricC2NPprofLookups[profile]; ok {
+		return m
+	}
+	return metricC2NPprofLookupOther
 }
@@ -4,14 +4,21 @@
 package ipnlocal
 
 import (
+	"bytes"
 	"cmp"
+	"compress/gzip"
+	"context"
 	"crypto/x509"
 	"encoding/json"
+	"io"
+	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
@@ -132,3 +139,361 @@ func TestHandleC2NTLSCertStatus(t *testing.T) {
 	}
 
 }
+
+func TestHandleC2NDebugCPUProfile(t *testing.T) {
+	b := &LocalBackend{}
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+	}{
+		{name: "one_second", query: "?seconds=1", wantStatus: 200},
+		{name: "bad_seconds", query: "?seconds=x", wantStatus: 400},
+		{name: "zero_seconds", query: "?seconds=0", wantStatus: 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			b.handleC2N(rec, httptest.NewRequest("GET", "/debug/pprof/profile"+tt.query, nil))
+			res := rec.Result()
+			if res.StatusCode != tt.wantStatus {
+				t.Fatalf("status code = %v; want %v. Body: %s", res.Status, tt.wantStatus, rec.Body.Bytes())
+			}
+			if tt.wantStatus == 200 && rec.Body.Len() == 0 {
+				t.Errorf("empty CPU profile")
+			}
+		})
+	}
+}
+
+func TestHandleC2NDebugCPUProfileConflict(t *testing.T) {
+	b := &LocalBackend{}
+
+	// Simulate a CPU profile already in progress.
+	c2nCPUProfileActive.Store(true)
+	t.Cleanup(func() { c2nCPUProfileActive.Store(false) })
+	rec := httptest.NewRecorder()
+	b.handleC2N(rec, httptest.NewRequest("GET", "/debug/pprof/profile?seconds=1", nil))
+	if got, want := rec.Code, http.StatusConflict; got != want {
+		t.Fatalf("overlapping CPU profile: status code = %v; want %v", got, want)
+	}
+	c2nCPUProfileActive.Store(false)
+
+	// A client going away mid-profile should end the profile early and
+	// release it for the next caller.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec = httptest.NewRecorder()
+	start := time.Now()
+	b.handleC2N(rec, httptest.NewRequest("GET", "/debug/pprof/profile?seconds=60", nil).WithContext(ctx))
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("cancelled CPU profile took %v", d)
+	}
+	if c2nCPUProfileActive.Load() {
+		t.Errorf("c2nCPUProfileActive still set after cancelled profile")
+	}
+}
+
+func TestHandleC2NDebugPprof(t *testing.T) {
+	b := &LocalBackend{}
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantError  string // wanted non-200 error
+		wantBody   string // if non-empty, wanted prefix of a 200 body
+
+		wantNotBody  string // if non-empty, unwanted prefix of a 200 body
+		wantContains string // if non-empty, wanted substring of a 200 body
+	}{
+		{name: "heap", query: "?profile=heap", wantStatus: 200},
+		{name: "goroutine", query: "?profile=goroutine", wantStatus: 200},
+		{name: "allocs", query: "?profile=allocs&gc=1", wantStatus: 200},
+		{name: "threadcreate", query: "?profile=threadcreate", wantStatus: 200},
+		{name: "threadcreate_debug1", query: "?profile=threadcreate&debug=1", wantStatus: 200, wantBody: "threadcreate profile: total "},
+		{name: "goroutine_debug1", query: "?profile=goroutine&debug=1", wantStatus: 200, wantBody: "goroutine profile: total "},
+		// debug=2 is the full dump, formatted like an unrecovered panic,
+		// rather than the debug=1 summary.
+		{name: "goroutine_debug2", query: "?profile=goroutine&debug=2", wantStatus: 200, wantBody: "goroutine ", wantNotBody: "goroutine profile:", wantContains: " [running]:\n"},
+		{name: "heap_debug1", query: "?profile=heap&debug=1", wantStatus: 200, wantBody: "heap profile: "},
+		{name: "missing", wantStatus: 400, wantError: "no 'profile'\n"},
+		{name: "unknown", query: "?profile=nonexistent", wantStatus: 400, wantError: "unknown profile\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			b.handleC2N(rec, httptest.NewRequest("GET", "/debug/pprof/lookup"+tt.query, nil))
+			res := rec.Result()
+			if res.StatusCode != tt.wantStatus {
+				t.Fatalf("status code = %v; want %v. Body: %s", res.Status, tt.wantStatus, rec.Body.Bytes())
+			}
+			if tt.wantStatus == 200 {
+				if rec.Body.Len() == 0 {
+					t.Errorf("empty profile")
+				}
+				got := rec.Body.String()
+				if !strings.HasPrefix(got, tt.wantBody) {
+					t.Errorf("body = %.40q...; want prefix %q", got, tt.wantBody)
+				}
+				if tt.wantNotBody != "" && strings.HasPrefix(got, tt.wantNotBody) {
+					t.Errorf("body = %.40q...; want no prefix %q", got, tt.wantNotBody)
+				}
+				if !strings.Contains(got, tt.wantContains) {
+					t.Errorf("body = %.40q...; want it to contain %q", got, tt.wantContains)
+				}
+			} else if got := rec.Body.String(); got != tt.wantError {
+				t.Errorf("body = %q; want %q", got, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestC2NProfileDuration(t *testing.T) {
+	tests := []struct {
+		query       string
+		def, maxDur time.Duration
+		want        time.Duration
+		wantErr     bool
+	}{
+		{query: "", def: 5 * time.Second, maxDur: 30 * time.Second, want: 5 * time.Second},
+		{query: "?seconds=10", def: 5 * time.Second, maxDur: 30 * time.Second, want: 10 * time.Second},
+		{query: "?seconds=600", def: 5 * time.Second, maxDur: 30 * time.Second, want: 30 * time.Second},
+		{query: "?seconds=-1", def: 5 * time.Second, maxDur: 30 * time.Second, wantErr: true},
+		{query: "?seconds=x", def: 5 * time.Second, maxDur: 30 * time.Second, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := c2nProfileDuration(httptest.NewRequest("GET", "/"+tt.query, nil), tt.def, tt.maxDur)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: err = %v; want error %v", tt.query, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %v; want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestHandleC2NDebugTrace(t *testing.T) {
+	b := &LocalBackend{}
+
+	// Simulate a trace already in progress.
+	c2nTraceActive.Store(true)
+	t.Cleanup(func() { c2nTraceActive.Store(false) })
+	rec := httptest.NewRecorder()
+	b.handleC2N(rec, httptest.NewRequest("GET", "/debug/pprof/trace?seconds=1", nil))
+	if got, want := rec.Code, http.StatusConflict; got != want {
+		t.Fatalf("overlapping trace: status code = %v; want %v", got, want)
+	}
+	c2nTraceActive.Store(false)
+
+	rec = httptest.NewRecorder()
+	b.handleC2N(rec, httptest.NewRequest("GET", "/debug/pprof/trace?seconds=1", nil))
+	if rec.Code != 200 {
+		t.Fatalf("status code = %v; want 200. Body: %s", rec.Code, rec.Body.Bytes())
+	}
+	if !bytes.HasPrefix(rec.Body.Bytes(), []byte("go 1.")) {
+		t.Errorf("body doesn't look like an execution trace: %q", rec.Body.Bytes()[:min(rec.Body.Len(), 16)])
+	}
+	if c2nTraceActive.Load() {
+		t.Errorf("c2nTraceActive still set after trace finished")
+	}
+}
+
+func TestHandleC2NDebugProfileRate(t *testing.T) {
+	b := &LocalBackend{}
+	defer runtime.SetMutexProfileFraction(runtime.SetMutexProfileFraction(-1))
+	defer runtime.SetBlockProfileRate(0)
+	defer func() {
+		c2nProfileRateMu.Lock()
+		defer c2nProfileRateMu.Unlock()
+		c2nBlockProfileRate = 0
+	}()
+	defer func(old int) { runtime.MemProfileRate = old }(runtime.MemProfileRate)
+
+	tests := []struct {
+		name       string
+		method     string
+		query      string
+		wantStatus int
+	}{
+		{name: "get", method: "GET", wantStatus: 200},
+		{name: "mutex", method: "POST", query: "?profile=mutex&rate=5", wantStatus: 200},
+		{name: "block", method: "POST", query: "?profile=block&rate=1000", wantStatus: 200},
+		{name: "heap", method: "POST", query: "?profile=heap&rate=4096", wantStatus: 200},
+		{name: "heap_zero", method: "POST", query: "?profile=heap&rate=0", wantStatus: 400},
+		{name: "unknown_profile", method: "POST", query: "?profile=goroutine&rate=5", wantStatus: 400},
+		{name: "missing_rate", method: "POST", query: "?profile=mutex", wantStatus: 400},
+		{name: "negative_rate", method: "POST", query: "?profile=block&rate=-1", wantStatus: 400},
+		{name: "bad_method", method: "PUT", query: "?profile=block&rate=1", wantStatus: 405},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			b.handleC2N(rec, httptest.NewRequest(tt.method, "/debug/pprof/rate"+tt.query, nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status code = %v; want %v. Body: %s", rec.Code, tt.wantStatus, rec.Body.Bytes())
+			}
+		})
+	}
+
+	rec := httptest.NewRecorder()
+	b.handleC2N(rec, httptest.NewRequest("GET", "/debug/pprof/rate", nil))
+	var got tailcfg.C2NPprofRates
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("bad JSON: %v", err)
+	}
+	want := tailcfg.C2NPprofRates{
+		MemProfileRate:       4096,
+		MutexProfileFraction: 5,
+		BlockProfileRate:     1000,
+	}
+	if got != want {
+		t.Errorf("got %v; want %v", logger.AsJSON(got), logger.AsJSON(want))
+	}
+}
+
+func TestHandleC2NDebugPprofGzip(t *testing.T) {
+	b := &LocalBackend{}
+	tests := []struct {
+		name     string
+		path     string
+		accept   string
+		wantGzip bool
+	}{
+		{name: "text_no_accept", path: "/debug/pprof/lookup?profile=goroutine&debug=2"},
+		{name: "text_gzip", path: "/debug/pprof/lookup?profile=goroutine&debug=2", accept: "gzip", wantGzip: true},
+		{name: "text_gzip_q", path: "/debug/pprof/lookup?profile=goroutine&debug=1", accept: "br, gzip;q=0.5", wantGzip: true},
+		{name: "text_gzip_q0", path: "/debug/pprof/lookup?profile=goroutine&debug=1", accept: "br, gzip;q=0"},
+		{name: "text_gzip_q0_spaces", path: "/debug/pprof/lookup?profile=goroutine&debug=1", accept: "gzip ; q=0.000"},
+		{name: "trace_gzip", path: "/debug/pprof/trace?seconds=1", accept: "gzip", wantGzip: true},
+		// The binary pprof format is already gzipped; don't compress it again.
+		{name: "proto_gzip", path: "/debug/pprof/lookup?profile=goroutine", accept: "gzip"},
+		{name: "heap_gzip", path: "/debug/logheap", accept: "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept-Encoding", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			b.handleC2N(rec, req)
+			if rec.Code != 200 {
+				t.Fatalf("status code = %v; want 200. Body: %s", rec.Code, rec.Body.Bytes())
+			}
+			gotEnc := rec.Header().Get("Content-Encoding")
+			if !tt.wantGzip {
+				if gotEnc != "" {
+					t.Fatalf("Content-Encoding = %q; want none", gotEnc)
+				}
+				return
+			}
+			if gotEnc != "gzip" {
+				t.Fatalf("Content-Encoding = %q; want gzip", gotEnc)
+			}
+			zr, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadAll(zr); err != nil {
+				t.Fatalf("reading gzipped body: %v", err)
+			}
+		})
+	}
+}
+
+func TestC2NPprofDebug(t *testing.T) {
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"", 0},
+		{"?debug=0", 0},
+		{"?debug=1", 1},
+		{"?debug=2", 2},
+		{"?debug=9", 2},
+		{"?debug=-1", 0},
+		{"?debug=x", 0},
+	}
+	for _, tt := range tests {
+		if got := c2nPprofDebug(httptest.NewRequest("GET", "/debug/pprof/lookup"+tt.query, nil)); got != tt.want {
+			t.Errorf("%q: got %v; want %v", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestHandleC2NDebugPprofProfiles(t *testing.T) {
+	b := &LocalBackend{}
+	rec := httptest.NewRecorder()
+	b.handleC2N(rec, httptest.NewRequest("GET", "/debug/pprof/profiles", nil))
+	if rec.Code != 200 {
+		t.Fatalf("status code = %v; want 200. Body: %s", rec.Code, rec.Body.Bytes())
+	}
+	var got []tailcfg.C2NPprofProfile
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("bad JSON: %v", err)
+	}
+	byName := map[string]tailcfg.C2NPprofProfile{}
+	for _, p := range got {
+		byName[p.Name] = p
+	}
+	for _, want := range []string{"allocs", "goroutine", "heap", "threadcreate"} {
+		p, ok := byName[want]
+		if !ok {
+			t.Errorf("profile %q not listed in %v", want, logger.AsJSON(got))
+			continue
+		}
+		if p.Description == "" {
+			t.Errorf("profile %q has no description", want)
+		}
+	}
+	if p := byName["goroutine"]; p.Count == 0 {
+		t.Errorf("goroutine profile Count = 0; want > 0")
+	}
+}
+
+func TestHandleC2NDebugPprofMetrics(t *testing.T) {
+	b := &LocalBackend{}
+	get := func(path string) {
+		t.Helper()
+		b.handleC2N(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	goroutines := metricC2NPprofLookup("goroutine").Value()
+	other := metricC2NPprofLookupOther.Value()
+	errs := metricC2NPprofErrors.Value()
+	profiles := metricC2NPprofProfiles.Value()
+	getRate := metricC2NPprofGetRate.Value()
+
+	get("/debug/pprof/lookup?profile=goroutine")
+	get("/debug/pprof/profiles")
+	get("/debug/pprof/rate")
+	if got := metricC2NPprofErrors.Value() - errs; got != 0 {
+		t.Errorf("error counter increased by %d on successful requests; want 0", got)
+	}
+
+	for _, tt := range []struct{ method, path string }{
+		{"GET", "/debug/pprof/lookup?profile=nonexistent"},
+		{"GET", "/debug/pprof/lookup"}, // missing profile
+		{"PUT", "/debug/pprof/rate"},   // bad method
+	} {
+		errs := metricC2NPprofErrors.Value()
+		b.handleC2N(httptest.NewRecorder(), httptest.NewRequest(tt.method, tt.path, nil))
+		if got := metricC2NPprofErrors.Value() - errs; got != 1 {
+			t.Errorf("%s %s: error counter increased by %d; want 1", tt.method, tt.path, got)
+		}
+	}
+
+	if got := metricC2NPprofLookup("goroutine").Value() - goroutines; got != 1 {
+		t.Errorf("goroutine counter increased by %d; want 1", got)
+	}
+	if got := metricC2NPprofLookupOther.Value() - other; got != 1 {
+		t.Errorf("other counter increased by %d; want 1", got)
+	}
+	if got := metricC2NPprofProfiles.Value() - profiles; got != 1 {
+		t.Errorf("profiles counter increased by %d; want 1", got)
+	}
+	if got := metricC2NPprofGetRate.Value() - getRate; got != 1 {
+		t.Errorf("get rate counter increased by %d; want 1", got)
+	}
+}
@@ -98,3 +98,45 @@ type C2NTLSCertInfo struct {
 	// TODO(bradfitz): add fields for whether an ACME fetch is currently in
 	// process and when it started, etc.
 }
+
+// C2NPprofProfile describes a runtime/pprof profile that can be fetched from
+// the node's /debug/pprof/lookup handler. The /debug/pprof/profiles handler
+// returns a JSON array of these.
+type C2NPprofProfile struct {
+	// Name is the profile name, to be passed as the "profile" parameter
+	// to /debug/pprof/lookup (e.g. "heap", "allocs", "threadcreate").
+	Name string
+
+	// Count is the number of entries currently in the profile.
+	Count int
+
+	// Description is a short human-readable description of the profile,
+	// if known.
+	Description string `json:",omitempty"`
+}
+
+// C2NPprofRates is the response from the node's /debug/pprof/rate handler.
+// It reports the runtime's current profile sampling rates.
+type C2NPprofRates struct {
+	// MemProfileRate is runtime.MemProfileRate: on average, one allocation
+	// is sampled per MemProfileRate bytes allocated. It determines the
+	// resolution of the heap and allocs profiles.
+	//
+	// Heap profiles taken after changing it mix samples recorded at the old
+	// and new rates. Investigators should note the rate before changing it
+	// and reset it once the capture is done.
+	MemProfileRate int
+
+	// MutexProfileFraction is the runtime.SetMutexProfileFraction rate: on
+	// average, 1/MutexProfileFraction of mutex contention events are
+	// reported. Zero means the mutex profile is disabled.
+	MutexProfileFraction int
+
+	// BlockProfileRate is the runtime.SetBlockProfileRate rate: on
+	// average, one blocking event is sampled per BlockProfileRate
+	// nanoseconds spent blocked. Zero means the block profile is disabled.
+	//
+	// The runtime has no way to read this rate back, so it is the value
+	// last set via c2n, or zero if it was never set that way.
+	BlockProfileRate int
+}
@@ -129,7 +129,8 @@
 //   - 86: 2024-01-23: Client understands NodeAttrProbeUDPLifetime
 //   - 87: 2024-02-11: UserProfile.Groups removed (added in 66)
 //   - 88: 2024-03-05: Client understands NodeAttrSuggestExitNode
-const CurrentCapabilityVersion CapabilityVersion = 88
+//   - 89: 2026-10-17: can handle c2n /debug/pprof/{profile,lookup,profiles,trace,rate}
+const CurrentCapabilityVersion CapabilityVersion = 89
 
 type StableID string
 